@@ -1,17 +1,101 @@
 package httpretry
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/hashicorp/go-cleanhttp"
 )
 
+// LeveledLogger is an interface that can be implemented by any leveled
+// logging library (e.g. hclog.Logger already satisfies this shape) to
+// provide structured logging for Client. Output is key/value pairs
+// following the message, e.g. logger.Debug("retrying", "attempt", 2).
+type LeveledLogger interface {
+	Error(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Debug(msg string, keysAndValues ...interface{})
+}
+
+// Logger is a minimal interface for basic, unleveled logging. A stdlib
+// *log.Logger already implements this, so it can be assigned to
+// Client.Logger directly.
+type Logger interface {
+	Printf(string, ...interface{})
+}
+
+// RequestLogHook allows a function to run before each retry attempt,
+// including the first, given the active logger, the request that is
+// about to be made, and the attempt number (starting at 0).
+type RequestLogHook func(logger LeveledLogger, req *http.Request, attempt int)
+
+// ResponseLogHook is like RequestLogHook, but allows running a function
+// on every HTTP response. This function will be invoked at the end of
+// every HTTP request, regardless of whether there will be a retry or not.
+type ResponseLogHook func(logger LeveledLogger, resp *http.Response)
+
+// noopLogger discards everything. It is the default when Client.Logger
+// is nil so the retry loop never has to nil-check before logging.
+type noopLogger struct{}
+
+func (noopLogger) Error(string, ...interface{}) {}
+func (noopLogger) Warn(string, ...interface{})  {}
+func (noopLogger) Info(string, ...interface{})  {}
+func (noopLogger) Debug(string, ...interface{}) {}
+
+// logLogger adapts a basic Logger (e.g. a stdlib *log.Logger) to the
+// LeveledLogger interface by prefixing each message with its level.
+type logLogger struct {
+	l Logger
+}
+
+func (l *logLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log("ERROR", msg, keysAndValues...)
+}
+func (l *logLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log("WARN", msg, keysAndValues...)
+}
+func (l *logLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log("INFO", msg, keysAndValues...)
+}
+func (l *logLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log("DEBUG", msg, keysAndValues...)
+}
+
+func (l *logLogger) log(level, msg string, keysAndValues ...interface{}) {
+	l.l.Printf("[%s] %s %v", level, msg, keysAndValues)
+}
+
+// leveledLogger resolves whatever is assigned to Client.Logger into a
+// LeveledLogger, so the retry loop always has one concrete type to call.
+func (c *Client) leveledLogger() LeveledLogger {
+	switch v := c.Logger.(type) {
+	case nil:
+		return noopLogger{}
+	case LeveledLogger:
+		return v
+	case Logger:
+		return &logLogger{l: v}
+	default:
+		// Client.Logger must be nil, a Logger, or a LeveledLogger; anything
+		// else can't be wired up safely, so fall back to discarding rather
+		// than silently routing around whatever the caller assigned.
+		return noopLogger{}
+	}
+}
+
 // CheckForRetry specifies a policy for handling retries. It is called
 // following each request with the reponse and error values returned by
 // the http.Client. If it returns false, the Client stops retrying
@@ -19,21 +103,77 @@ import (
 // that error value is return in lieu of the error from the request.
 type CheckForRetry func(resp *http.Response, err error) (bool, error)
 
-// DefaultRetryPolicy provides a default callback for Client.CheckForRetry,
-// which will retry on connection errors and server errors.
-func DefaultRetryPolicy(resp *http.Response, err error) (bool, error) {
+var (
+	// redirectsErrorRe matches the error net/http returns when a request
+	// was stopped after following too many redirects.
+	redirectsErrorRe = regexp.MustCompile(`stopped after \d+ redirects\z`)
+
+	// schemeErrorRe matches the error net/http returns when a redirect
+	// points at an unsupported protocol scheme.
+	schemeErrorRe = regexp.MustCompile(`unsupported protocol scheme`)
+)
+
+// baseRetryPolicy classifies an error/response pair, returning whether it
+// is worth retrying. It never itself returns a non-nil error; callers
+// decide whether to propagate the original error via their return value.
+func baseRetryPolicy(resp *http.Response, err error) (bool, error) {
 	if err != nil {
-		return true, err
+		if v, ok := err.(*url.Error); ok {
+			// Don't retry if the request was malformed in the first place.
+			if v.Op == "parse" {
+				return false, nil
+			}
+			// Don't retry if we ran out of redirects or hit an unsupported scheme.
+			if redirectsErrorRe.MatchString(v.Error()) || schemeErrorRe.MatchString(v.Error()) {
+				return false, nil
+			}
+			// Don't retry on TLS certificate problems; they won't fix themselves.
+			switch v.Err.(type) {
+			case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+				return false, nil
+			}
+		}
+		// Anything else (connection refused/reset, timeouts, EOF, ...) is
+		// likely transient, so retry.
+		return true, nil
+	}
+
+	// 429 Too Many Requests is recoverable, and the server may have sent
+	// a Retry-After header indicating how long to wait.
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true, nil
 	}
-	// Check the response code. Here we retry on 500-range responses to
-	// allow the server time to recover.
-	if resp.StatusCode == 0 || resp.StatusCode == 503 {
+
+	// Check the response code. We retry on 500-range responses to allow
+	// the server time to recover, except 501 Not Implemented, which is a
+	// permanent condition. This also catches invalid codes like 0.
+	if resp.StatusCode == 0 || (resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented) {
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// DefaultRetryPolicy provides a default callback for Client.CheckForRetry,
+// which will retry on connection errors and server errors. Unlike this
+// function's original behaviour, which propagated the request error
+// verbatim, it now swallows the original error in favor of a nil error;
+// use ErrorPropagatedRetryPolicy for the previous behaviour.
+func DefaultRetryPolicy(resp *http.Response, err error) (bool, error) {
+	shouldRetry, _ := baseRetryPolicy(resp, err)
+	return shouldRetry, nil
+}
+
+// ErrorPropagatedRetryPolicy is identical to DefaultRetryPolicy, except
+// that it returns the original request error alongside its decision
+// instead of discarding it. Client.Do returns the request error when it
+// stops retrying under either policy, since a nil error from the policy
+// leaves the request error in place.
+func ErrorPropagatedRetryPolicy(resp *http.Response, err error) (bool, error) {
+	shouldRetry, _ := baseRetryPolicy(resp, err)
+	return shouldRetry, err
+}
+
 // Backoff specifies a policy for how long to wait between retries.
 // It is called after a failing request to determine the amount of time
 // that should pass before trying again.
@@ -41,14 +181,62 @@ type Backoff func(min, max time.Duration, attemptNum int, resp *http.Response) t
 
 // DefaultBackoff provides a default callback for Client.Backoff which
 // will perform exponential backoff based on the attempt number and limited
-// by the provided minimum and maximum durations.
+// by the provided minimum and maximum durations, with randomized jitter
+// to avoid many clients retrying in lockstep.
 func DefaultBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
 	mult := math.Pow(2, float64(attemptNum)) * float64(min)
 	sleep := time.Duration(mult)
 	if float64(sleep) != mult || sleep > max {
 		sleep = max
 	}
-	return sleep
+	// Jitter uniformly in [sleep, 2*sleep], capped at max, so clients
+	// retrying after the same error don't all wake up at the same instant.
+	jittered := sleep + time.Duration(rand.Int63n(int64(sleep)+1))
+	if jittered > max {
+		jittered = max
+	}
+	return jittered
+}
+
+// DefaultBackoffWithRetryAfter wraps DefaultBackoff, but first checks the
+// response for a Retry-After header (delta-seconds or an HTTP-date, as
+// used on 429 and 503 responses) and uses that wait instead, clamped to
+// [min, max], when present.
+func DefaultBackoffWithRetryAfter(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if wait < min {
+				wait = min
+			}
+			if wait > max {
+				wait = max
+			}
+			return wait
+		}
+	}
+	return DefaultBackoff(min, max, attemptNum, resp)
+}
+
+// parseRetryAfter parses a Retry-After header value, which per RFC 7231
+// is either a number of delta-seconds or an HTTP-date.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
 }
 
 var (
@@ -58,6 +246,11 @@ var (
 	defaultRetryMax     = 4
 )
 
+// defaultRespReadLimit is the default number of bytes Client.drainBody
+// will read from a retryable response before giving up on reusing the
+// connection.
+const defaultRespReadLimit = 4 * 1024
+
 // Client is used to make TTP requests. It adds additional functionality
 // like automatic retries to tolerate minor outages.
 type Client struct {
@@ -72,8 +265,40 @@ type Client struct {
 
 	// Backoff specifies the policy for how long to wait between retries
 	Backoff Backoff
+
+	// Logger is the logger used by the Client. It may be nil (the
+	// default, which discards everything), a Logger (e.g. a stdlib
+	// *log.Logger), or a LeveledLogger (e.g. an hclog.Logger).
+	Logger interface{}
+
+	// RequestLogHook, if set, is called before each attempt, including
+	// the first, allowing a caller to log or mutate the outgoing request.
+	RequestLogHook RequestLogHook
+
+	// ResponseLogHook, if set, is called after every HTTP response,
+	// whether or not the request will be retried.
+	ResponseLogHook ResponseLogHook
+
+	// RequestTimeout, if non-zero, bounds each individual attempt in its
+	// own context.WithTimeout derived from the request's context, so a
+	// single slow attempt cannot consume the whole retry budget.
+	RequestTimeout time.Duration
+
+	// ErrorHandler, if set, is called once the retry budget is exhausted
+	// and is responsible for producing the final response/error pair
+	// returned to the caller, in place of the default "giving up" error.
+	ErrorHandler ErrorHandler
+
+	// RespReadLimit caps the number of bytes drained from a retryable
+	// response body before it is closed. Defaults to 4KiB if left zero.
+	RespReadLimit int64
 }
 
+// ErrorHandler is called when the retry budget of a Client has been
+// exhausted, and is responsible for returning the final response/error
+// pair for a call to Client.Do.
+type ErrorHandler func(resp *http.Response, err error, numTries int) (*http.Response, error)
+
 // NewClient creates a new client with default settings
 func NewClient() *Client {
 	return &Client{
@@ -82,59 +307,213 @@ func NewClient() *Client {
 		RetryWaitMax:  defaultRetryWaitMax,
 		RetryMax:      defaultRetryMax,
 		CheckForRetry: DefaultRetryPolicy,
-		Backoff:       DefaultBackoff,
+		Backoff:       DefaultBackoffWithRetryAfter,
+		RespReadLimit: defaultRespReadLimit,
 	}
 }
 
+// ReaderFunc is the type of function that can be given natively to
+// NewRequestWithContext, or via Request.SetBody. It returns a fresh
+// io.Reader over the request body on every call, so that Client.Do can
+// re-read the body on every retry attempt without relying on Seek.
+type ReaderFunc func() (io.Reader, error)
+
+// LenReader is implemented by many in-memory io.Reader types (bytes.Buffer,
+// bytes.Reader, strings.Reader) and lets SetBody populate ContentLength
+// without consuming the reader.
+type LenReader interface {
+	Len() int
+}
+
 // Request wraps the metadata needed to create HTTP requests
 type Request struct {
-	// body is a seekable rader over the request body payload. This is
-	// used to rewind the request data in between retries.
-	body io.ReadSeeker
+	// body returns a fresh reader over the request body payload on every
+	// call. This is used to rebuild the request data between retries.
+	body ReaderFunc
 
 	// Embed an HTTP request directly. This makes a *Request act exacty
 	// like an *http.Request so that all meta methods are supported.
 	*http.Request
 }
 
-// NewRequestWithContext creates a new wrapped request
-func NewRequestWithContext(ctx context.Context, method, url string, body io.ReadSeeker) (*Request, error) {
-	// Wrap the body in a noop ReadCloser if non-nil. This prevents the
-	// reader from being closed by the HTTP client.
-	var rcBody io.ReadCloser
-	if body != nil {
-		rcBody = ioutil.NopCloser(body)
+// SetBody sets the body of the request, wrapping rawBody into a
+// ReaderFunc so it can be re-read on every retry attempt. Accepted types
+// are: nil, []byte, *bytes.Buffer, *bytes.Reader, io.ReadSeeker,
+// io.Reader, and ReaderFunc. An io.Reader that is not also a seeker is
+// read into memory once up front so it can be replayed on retries.
+func (r *Request) SetBody(rawBody interface{}) error {
+	switch body := rawBody.(type) {
+	case ReaderFunc:
+		r.body = body
+		tmp, err := body()
+		if err != nil {
+			return err
+		}
+		if lr, ok := tmp.(LenReader); ok {
+			r.ContentLength = int64(lr.Len())
+		}
+		if c, ok := tmp.(io.Closer); ok {
+			c.Close()
+		}
+
+	case func() (io.Reader, error):
+		return r.SetBody(ReaderFunc(body))
+
+	case []byte:
+		r.body = func() (io.Reader, error) {
+			return bytes.NewReader(body), nil
+		}
+		r.ContentLength = int64(len(body))
+
+	case *bytes.Buffer:
+		buf := body.Bytes()
+		r.body = func() (io.Reader, error) {
+			return bytes.NewReader(buf), nil
+		}
+		r.ContentLength = int64(body.Len())
+
+	case *bytes.Reader:
+		snapshot := *body
+		r.body = func() (io.Reader, error) {
+			r := snapshot
+			return &r, nil
+		}
+		r.ContentLength = int64(body.Len())
+
+	case io.ReadSeeker:
+		raw := body
+		r.body = func() (io.Reader, error) {
+			if _, err := raw.Seek(0, 0); err != nil {
+				return nil, fmt.Errorf("failed to seek body: %v", err)
+			}
+			return ioutil.NopCloser(raw), nil
+		}
+		if lr, ok := raw.(LenReader); ok {
+			r.ContentLength = int64(lr.Len())
+		}
+
+	case io.Reader:
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		r.body = func() (io.Reader, error) {
+			return bytes.NewReader(buf), nil
+		}
+		r.ContentLength = int64(len(buf))
+
+	case nil:
+		// No body.
+
+	default:
+		return fmt.Errorf("cannot handle type %T as a request body", rawBody)
 	}
 
-	// Make the request with the noop-closer for the body
-	httpReq, err := http.NewRequestWithContext(ctx, method, url, rcBody)
+	if r.body != nil {
+		r.GetBody = func() (io.ReadCloser, error) {
+			body, err := r.body()
+			if err != nil {
+				return nil, err
+			}
+			if rc, ok := body.(io.ReadCloser); ok {
+				return rc, nil
+			}
+			return ioutil.NopCloser(body), nil
+		}
+	}
+
+	return nil
+}
+
+// NewRequestWithContext creates a new wrapped request. body may be nil,
+// []byte, *bytes.Buffer, *bytes.Reader, io.ReadSeeker, io.Reader, or a
+// ReaderFunc; see Request.SetBody for how each is handled.
+func NewRequestWithContext(ctx context.Context, method, url string, body interface{}) (*Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Request{body, httpReq}, nil
+	req := &Request{Request: httpReq}
+	if err := req.SetBody(body); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// NewRequest is an alias of NewRequestWithContext, provided for callers
+// that prefer the shorter name.
+func NewRequest(ctx context.Context, method, url string, body interface{}) (*Request, error) {
+	return NewRequestWithContext(ctx, method, url, body)
+}
+
+// cancelOnClose wraps a response body so the per-attempt context backing
+// it is cancelled only once the caller is done reading it (on Close),
+// instead of being torn down the instant HTTPClient.Do returns.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
 }
 
 // Do wraps calling an HTTP method with retries
 func (c *Client) Do(req *Request) (*http.Response, error) {
+	logger := c.leveledLogger()
+
+	var resp *http.Response
+	var err error
+
 	for i := 0; i < c.RetryMax; i++ {
 		var code int // HTTP response code
 
-		// Always rewind the request body when non-nil
+		// Rebuild the request body from scratch for every attempt, so
+		// retries work even when the original body isn't seekable.
 		if req.body != nil {
-			if _, err := req.body.Seek(0, 0); err != nil {
-				return nil, fmt.Errorf("failed to seek body: %v", err)
+			body, bodyErr := req.body()
+			if bodyErr != nil {
+				return nil, bodyErr
+			}
+			if rc, ok := body.(io.ReadCloser); ok {
+				req.Body = rc
+			} else {
+				req.Body = ioutil.NopCloser(body)
 			}
 		}
 
+		// If a per-attempt timeout is configured, derive a context for
+		// just this attempt so one slow attempt can't consume the whole
+		// retry budget. The request's own context still governs
+		// cancellation across attempts.
+		attemptReq := req.Request
+		cancel := func() {}
+		if c.RequestTimeout > 0 {
+			var attemptCtx context.Context
+			attemptCtx, cancel = context.WithTimeout(req.Context(), c.RequestTimeout)
+			attemptReq = req.Request.WithContext(attemptCtx)
+		}
+
+		if c.RequestLogHook != nil {
+			c.RequestLogHook(logger, attemptReq, i)
+		}
+
 		// Attempt the request
-		resp, err := c.HTTPClient.Do(req.Request)
+		resp, err = c.HTTPClient.Do(attemptReq)
+
+		if c.ResponseLogHook != nil && err == nil {
+			c.ResponseLogHook(logger, resp)
+		}
 
 		// Check if we should continue with retries
 		checkOK, checkErr := c.CheckForRetry(resp, err)
 
 		if err != nil {
-			fmt.Printf("[ERROR] %s %s request failed: %v\n", req.Method, req.URL, err)
+			logger.Error("request failed", "method", req.Method, "url", req.URL, "error", err)
 		} else {
 			// Call this here to maintain the behaviour of logging all requests, etc
 			// even if CheckForRetry signals to stop.
@@ -145,16 +524,28 @@ func (c *Client) Do(req *Request) (*http.Response, error) {
 			if checkErr != nil {
 				err = checkErr
 			}
+			// The caller is about to read resp.Body, which is tied to
+			// attemptReq's context: cancelling now would tear down the
+			// in-flight body mid-stream. Defer the cancel until the caller
+			// closes the body instead of firing it eagerly here.
+			if resp != nil && resp.Body != nil {
+				resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			} else {
+				cancel()
+			}
 			return resp, err
 		}
 
 		// We're going to retry, consume any response to re-use the connection
 		if err == nil {
-			c.drainBody(resp.Body)
+			c.drainBody(req.Context(), resp.Body)
 		}
+		// Nothing further will read from this attempt, so free its context
+		// now rather than waiting for the next attempt to start.
+		cancel()
 
-		remain := c.RetryMax - i
-		if remain == 0 {
+		remain := c.RetryMax - i - 1
+		if remain <= 0 {
 			break
 		}
 		wait := c.Backoff(c.RetryWaitMin, c.RetryWaitMax, i, resp)
@@ -162,20 +553,65 @@ func (c *Client) Do(req *Request) (*http.Response, error) {
 		if code > 0 {
 			desc = fmt.Sprintf("%s (status: %d)", desc, code)
 		}
-		fmt.Printf("[DEBUG] %s: retrying in %s (%d left)\n", desc, wait, remain)
-		time.Sleep(wait)
+		logger.Debug("retrying", "request", desc, "wait", wait, "remaining", remain)
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return resp, req.Context().Err()
+		}
 	}
 
-	// Return an error if we fall out of the retry loop
-	return nil, fmt.Errorf("%s %s giving up after %d attempts", req.Method, req.URL, c.RetryMax+1)
+	// We fell out of the retry loop with the budget exhausted. Let the
+	// caller produce the final result if it wants to, otherwise fall
+	// back to a generic "giving up" error that still carries the last
+	// response through, rather than dropping it.
+	if c.ErrorHandler != nil {
+		return c.ErrorHandler(resp, err, c.RetryMax)
+	}
+	if err == nil {
+		err = fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return resp, fmt.Errorf("%s %s giving up after %d attempts: %w", req.Method, req.URL, c.RetryMax, err)
 }
 
-// Try to read the response body so we can reuse this connection
-func (c *Client) drainBody(body io.ReadCloser) {
+// Try to read the response body so we can reuse this connection. Only up
+// to c.RespReadLimit bytes are drained, so a misbehaving server streaming
+// megabytes on a retryable response can't block the retry loop or waste
+// bandwidth; the connection just won't be reused in that case.
+func (c *Client) drainBody(ctx context.Context, body io.ReadCloser) {
 	defer body.Close()
-	_, err := io.Copy(ioutil.Discard, body)
-	if err != nil {
-		fmt.Printf("[ERROR] error reading response body: %v", err)
+
+	limit := c.RespReadLimit
+	if limit <= 0 {
+		limit = defaultRespReadLimit
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := io.CopyN(ioutil.Discard, body, limit)
+		if err != nil && err != io.EOF {
+			c.leveledLogger().Error("error reading response body", "error", err)
+			return
+		}
+		if n == limit {
+			// Copying exactly limit bytes doesn't tell us whether the body
+			// actually had more to give; a body that happens to be exactly
+			// limit bytes long shouldn't trigger the warning below. Peek
+			// one more byte to find out.
+			var extra [1]byte
+			if m, _ := body.Read(extra[:]); m > 0 {
+				c.leveledLogger().Warn("response body drain limit reached, discarding remainder", "limit", limit)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Closing body (via the deferred call above) will unblock the
+		// in-flight io.Copy.
 	}
 }
 
@@ -189,7 +625,7 @@ func (c *Client) Get(url string) (*http.Response, error) {
 }
 
 // Post is a convenience helper for doing simple POST requests
-func (c *Client) Post(url, bodyType string, body io.ReadSeeker) (*http.Response, error) {
+func (c *Client) Post(url, bodyType string, body interface{}) (*http.Response, error) {
 	req, err := NewRequestWithContext(context.Background(), "POST", url, body)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,60 @@
+package httpretry
+
+import (
+	"net/http"
+	"sync"
+)
+
+// RoundTripper wraps a Client and satisfies http.RoundTripper, so the
+// retrying client can be handed to any library that expects a stock
+// *http.Client (AWS SDK, oauth2, GraphQL clients, etc.) instead of a
+// *httpretry.Request.
+type RoundTripper struct {
+	// Client is the underlying retrying client. If nil, a client with
+	// NewClient's defaults is created on first use.
+	Client *Client
+
+	once sync.Once
+}
+
+// RoundTrip satisfies the http.RoundTripper interface.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.once.Do(func() {
+		if rt.Client == nil {
+			rt.Client = NewClient()
+		}
+	})
+
+	// RoundTrip must always close the request body, including on errors;
+	// NewRequestWithContext only reads it into retryableReq, it never
+	// closes the original.
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	retryableReq, err := NewRequestWithContext(req.Context(), req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		return nil, err
+	}
+	retryableReq.Header = req.Header
+	retryableReq.Host = req.Host
+	retryableReq.ContentLength = req.ContentLength
+	retryableReq.Trailer = req.Trailer
+
+	resp, err := rt.Client.Do(retryableReq)
+	if err != nil {
+		// http.RoundTripper must not return a non-nil Response alongside
+		// a non-nil error; Client.Do can return both on its giving-up path.
+		return nil, err
+	}
+	return resp, nil
+}
+
+// StandardClient returns a stock *http.Client whose Transport is a
+// RoundTripper wrapping c, so c can be used anywhere a *http.Client is
+// expected without adopting the *httpretry.Request wrapper.
+func (c *Client) StandardClient() *http.Client {
+	return &http.Client{
+		Transport: &RoundTripper{Client: c},
+	}
+}